@@ -6,24 +6,39 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack/v5"
 	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/dapr/dapr/tests/apps/pubsub-subscriber/pblite"
 )
 
 const (
-	appPort = 3000
-	pubsubA = "pubsub-a-topic"
-	pubsubB = "pubsub-b-topic"
-	pubsubC = "pubsub-c-topic"
+	appPort   = 3000
+	pubsubA   = "pubsub-a-topic"
+	pubsubB   = "pubsub-b-topic"
+	pubsubC   = "pubsub-c-topic"
+	pubsubDLQ = "pubsub-dlq-topic"
+
+	contentTypeCloudEvent = "application/cloudevents+json"
+	redeliveryCountHeader = "dapr-redelivery-count"
+
+	codecJSON     = "json"
+	codecProtobuf = "protobuf"
+	codecMsgpack  = "msgpack"
 )
 
 type appResponse struct {
@@ -40,10 +55,230 @@ type receivedMessagesResponse struct {
 	ReceivedByTopicC []string `json:"pubsub-c-topic"`
 }
 
+// cloudEvent represents (a subset of) the CloudEvents 1.0 envelope:
+// https://gitpro.ttaallkk.top/cloudevents/spec/blob/v1.0/spec.md
+type cloudEvent struct {
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	SpecVersion     string      `json:"specversion"`
+	DataContentType string      `json:"datacontenttype,omitempty"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time,omitempty"`
+	Data            interface{} `json:"data,omitempty"`
+	DataBase64      string      `json:"data_base64,omitempty"`
+	// Topic is the dapr "topic" extension attribute: the topic the message
+	// was originally published to, carried along on dead-letter redelivery.
+	Topic string `json:"topic,omitempty"`
+	// TraceParent/TraceState are the W3C trace-context CloudEvents extension
+	// attributes dapr attaches for distributed tracing propagation.
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
 type subscription struct {
-	PubsubName string `json:"pubsubname"`
-	Topic      string `json:"topic"`
-	Route      string `json:"route"`
+	PubsubName      string               `json:"pubsubname"`
+	Topic           string               `json:"topic"`
+	Route           string               `json:"route"`
+	DeadLetterTopic string               `json:"deadLetterTopic,omitempty"`
+	BulkSubscribe   *bulkSubscribeConfig `json:"bulkSubscribe,omitempty"`
+}
+
+type bulkSubscribeConfig struct {
+	Enabled            bool `json:"enabled"`
+	MaxMessagesCount   int  `json:"maxMessagesCount"`
+	MaxAwaitDurationMs int  `json:"maxAwaitDurationMs"`
+}
+
+// bulkEntry is a single message within a /dapr/subscribe-bulk delivery.
+type bulkEntry struct {
+	EntryID string          `json:"entryId"`
+	Event   json.RawMessage `json:"event"`
+}
+
+type bulkSubscribeRequest struct {
+	Entries []bulkEntry `json:"entries"`
+}
+
+type entryStatus struct {
+	EntryID string `json:"entryId"`
+	Status  string `json:"status"`
+}
+
+type bulkSubscribeResponse struct {
+	Statuses []entryStatus `json:"statuses"`
+}
+
+// deadLetterRecord is what /tests/get-deadletters reports for a single
+// message that was routed to the dead-letter topic.
+type deadLetterRecord struct {
+	OriginalTopic   string `json:"originalTopic"`
+	ID              string `json:"id"`
+	RedeliveryCount int    `json:"redeliveryCount"`
+	Status          string `json:"status"`
+}
+
+type bulkStatsResponse struct {
+	Delivered  int `json:"delivered"`
+	Retried    int `json:"retried"`
+	Dropped    int `json:"dropped"`
+	Duplicated int `json:"duplicated"`
+}
+
+// streamEvent is what /tests/stream emits for a message accepted by subscribeHandler.
+type streamEvent struct {
+	ID         string `json:"id"`
+	Msg        string `json:"msg"`
+	ReceivedAt string `json:"receivedAt"`
+}
+
+// topicEvent pairs a streamEvent with the topic it was published on, since
+// that topic becomes the SSE "event:" field.
+type topicEvent struct {
+	topic string
+	event streamEvent
+}
+
+// messageBroker fans out topicEvents to any number of /tests/stream clients.
+// Each subscriber gets its own buffered channel; a slow client that lets its
+// buffer fill up has events dropped for it rather than blocking publishers.
+type messageBroker struct {
+	mu          sync.RWMutex
+	subscribers map[int]chan topicEvent
+	nextID      int
+}
+
+func newMessageBroker() *messageBroker {
+	return &messageBroker{subscribers: map[int]chan topicEvent{}}
+}
+
+func (b *messageBroker) subscribe() (int, <-chan topicEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan topicEvent, 16)
+	b.subscribers[id] = ch
+	return id, ch
+}
+
+func (b *messageBroker) unsubscribe(id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch, ok := b.subscribers[id]; ok {
+		delete(b.subscribers, id)
+		close(ch)
+	}
+}
+
+func (b *messageBroker) publish(topic string, event streamEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- topicEvent{topic: topic, event: event}:
+		default:
+			// subscriber's buffer is full, drop this event for it
+		}
+	}
+}
+
+var broker = newMessageBroker()
+
+// Codec decodes a pub/sub message body into the message id (if any) and its
+// raw data payload, based on the request's Content-Type.
+type Codec interface {
+	Decode(contentType string, body []byte) (id string, payload []byte, err error)
+}
+
+// jsonCodec decodes the legacy flat envelope: {"data": "...", "id": "..."}.
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(_ string, body []byte) (string, []byte, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(body, &m); err != nil {
+		return "", nil, err
+	}
+	data, ok := m["data"].(string)
+	if !ok {
+		return "", nil, errors.New("data is not a string")
+	}
+	id, _ := m["id"].(string)
+	return id, []byte(data), nil
+}
+
+// protobufCodec decodes the body as a pblite.TestMessage.
+type protobufCodec struct{}
+
+func (protobufCodec) Decode(_ string, body []byte) (string, []byte, error) {
+	msg, err := pblite.Unmarshal(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return msg.Id, msg.Payload, nil
+}
+
+// msgpackCodec decodes the body as a msgpack-encoded {id, payload} map.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Decode(_ string, body []byte) (string, []byte, error) {
+	var m struct {
+		ID      string `msgpack:"id"`
+		Payload []byte `msgpack:"payload"`
+	}
+	if err := msgpack.Unmarshal(body, &m); err != nil {
+		return "", nil, err
+	}
+	return m.ID, m.Payload, nil
+}
+
+var codecs = map[string]Codec{
+	codecJSON:     jsonCodec{},
+	codecProtobuf: protobufCodec{},
+	codecMsgpack:  msgpackCodec{},
+}
+
+// contentTypeCodecs maps a request's Content-Type to the codec that
+// understands it, including the CloudEvents structured-mode variants.
+var contentTypeCodecs = map[string]string{
+	"application/json":                 codecJSON,
+	"application/x-protobuf":           codecProtobuf,
+	"application/cloudevents+protobuf": codecProtobuf,
+	"application/msgpack":              codecMsgpack,
+}
+
+// forcedCodec, set via /tests/set-codec, overrides Content-Type-based codec
+// selection so negative tests can force a mismatched decode.
+var forcedCodec string
+
+// resolveCodec picks the Codec to use for contentType, honoring forcedCodec
+// when set and falling back to jsonCodec for unrecognized content types to
+// preserve the original flat-envelope behavior.
+func resolveCodec(contentType string) Codec {
+	lock.Lock()
+	name := forcedCodec
+	lock.Unlock()
+
+	if name == "" {
+		name = contentTypeCodecs[contentType]
+	}
+	if codec, ok := codecs[name]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+// baseContentType strips any parameters (e.g. "; charset=utf-8") from a
+// Content-Type header value.
+func baseContentType(contentType string) string {
+	base, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return base
 }
 
 var (
@@ -51,13 +286,30 @@ var (
 	receivedMessagesA sets.String
 	receivedMessagesB sets.String
 	receivedMessagesC sets.String
+	// received CloudEvents envelopes, keyed by topic then by event id (or by the
+	// message content when the event has no id), so e2e
+	// tests can assert on attribute propagation (tracing, subject, datacontenttype).
+	receivedCloudEvents map[string]map[string]cloudEvent
 	// boolean variable to respond with empty json message
 	respondWithEmptyJSON bool
 	// boolean variable to respond with error if set
 	respondWithError bool
 	// boolean variable to respond with retry if set
 	respondWithRetry bool
-	lock             sync.Mutex
+	// entryId substring that bulk entries must match for the respond-with-error/
+	// retry toggles to apply to them, set via /tests/set-bulk-failure-pattern;
+	// empty means the toggles apply to every entry.
+	bulkFailurePattern string
+	bulkStats          bulkStatsResponse
+	// failAfterCount is the number of times a message must be retried (per
+	// topic) before subscribeHandler responds with SUCCESS, set via
+	// /tests/set-fail-after. deliveryAttempts tracks attempts seen so far,
+	// keyed by deliveryKey(topic, id) so id-less messages on different
+	// topics don't share a counter.
+	failAfterCount      map[string]int
+	deliveryAttempts    map[string]int
+	receivedDeadLetters map[string]deadLetterRecord
+	lock                sync.Mutex
 )
 
 // indexHandler is the handler for root path
@@ -77,19 +329,27 @@ func configureSubscribeHandler(w http.ResponseWriter, _ *http.Request) {
 
 	t := []subscription{
 		{
-			PubsubName: pubsubName,
-			Topic:      pubsubA,
-			Route:      pubsubA,
+			PubsubName:      pubsubName,
+			Topic:           pubsubA,
+			Route:           pubsubA,
+			DeadLetterTopic: pubsubDLQ,
 		},
 		{
-			PubsubName: pubsubName,
-			Topic:      pubsubB,
-			Route:      pubsubB,
+			PubsubName:      pubsubName,
+			Topic:           pubsubB,
+			Route:           pubsubB,
+			DeadLetterTopic: pubsubDLQ,
+		},
+		{
+			PubsubName:      pubsubName,
+			Topic:           pubsubC,
+			Route:           pubsubC,
+			DeadLetterTopic: pubsubDLQ,
 		},
 		{
 			PubsubName: pubsubName,
-			Topic:      pubsubC,
-			Route:      pubsubC,
+			Topic:      pubsubDLQ,
+			Route:      pubsubDLQ,
 		},
 	}
 	log.Printf("configureSubscribeHandler subscribing to:%v\n", t)
@@ -98,6 +358,217 @@ func configureSubscribeHandler(w http.ResponseWriter, _ *http.Request) {
 	json.NewEncoder(w).Encode(t)
 }
 
+// this handles /dapr/subscribe-bulk, which is called from dapr into this app.
+// this returns the list of topics the app is bulk-subscribed to.
+func configureBulkSubscribeHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Printf("configureBulkSubscribeHandler called\n")
+
+	pubsubName := "messagebus"
+	bulkConfig := &bulkSubscribeConfig{
+		Enabled:            true,
+		MaxMessagesCount:   100,
+		MaxAwaitDurationMs: 1000,
+	}
+
+	t := []subscription{
+		{PubsubName: pubsubName, Topic: pubsubA, Route: pubsubA + "-bulk", BulkSubscribe: bulkConfig},
+		{PubsubName: pubsubName, Topic: pubsubB, Route: pubsubB + "-bulk", BulkSubscribe: bulkConfig},
+		{PubsubName: pubsubName, Topic: pubsubC, Route: pubsubC + "-bulk", BulkSubscribe: bulkConfig},
+	}
+	log.Printf("configureBulkSubscribeHandler subscribing to:%v\n", t)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t)
+}
+
+// this handles bulk messages published to "pubsub-a-topic-bulk" (etc.)
+func bulkSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("bulkSubscribeHandler is called %s\n", r.URL)
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(appResponse{Message: err.Error(), Status: "DROP"})
+		return
+	}
+
+	var req bulkSubscribeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(appResponse{Message: err.Error(), Status: "DROP"})
+		return
+	}
+
+	var urlTopic string
+	urlPath := strings.TrimSuffix(r.URL.String(), "-bulk")
+	switch {
+	case strings.HasSuffix(urlPath, pubsubA):
+		urlTopic = pubsubA
+	case strings.HasSuffix(urlPath, pubsubB):
+		urlTopic = pubsubB
+	case strings.HasSuffix(urlPath, pubsubC):
+		urlTopic = pubsubC
+	}
+
+	// decode every entry before taking lock, since extractMessage takes lock
+	// itself to resolve the codec.
+	msgs := make([]string, len(req.Entries))
+	decodeErrs := make([]error, len(req.Entries))
+	for i, entry := range req.Entries {
+		msgs[i], _, decodeErrs[i] = extractMessage(r, entry.Event)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	statuses := make([]entryStatus, 0, len(req.Entries))
+	for i, entry := range req.Entries {
+		status := bulkEntryStatus(urlTopic, entry, msgs[i], decodeErrs[i])
+		statuses = append(statuses, entryStatus{EntryID: entry.EntryID, Status: status})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if respondWithEmptyJSON {
+		w.Write([]byte("{}"))
+	} else {
+		json.NewEncoder(w).Encode(bulkSubscribeResponse{Statuses: statuses})
+	}
+}
+
+// bulkEntryStatus processes a single bulk entry, whose event the caller has
+// already decoded into msg (or failed to, with decodeErr), updates the dedup
+// sets and bulkStats, and returns the ack status for that entry. Caller must
+// hold lock.
+func bulkEntryStatus(topic string, entry bulkEntry, msg string, decodeErr error) string {
+	// bulkFailurePattern narrows which entries the global toggles apply to;
+	// with no pattern set, the toggles apply to every entry, same as they
+	// apply to every message in subscribeHandler.
+	affected := bulkFailurePattern == "" || strings.Contains(entry.EntryID, bulkFailurePattern)
+	if affected && respondWithRetry {
+		bulkStats.Retried++
+		return "RETRY"
+	}
+	if affected && respondWithError {
+		bulkStats.Dropped++
+		return "DROP"
+	}
+
+	if decodeErr != nil {
+		bulkStats.Dropped++
+		return "DROP"
+	}
+
+	set := receivedMessagesSet(topic)
+	if set == nil {
+		bulkStats.Dropped++
+		return "DROP"
+	}
+
+	if set.Has(msg) {
+		bulkStats.Duplicated++
+		return "SUCCESS"
+	}
+	set.Insert(msg)
+	bulkStats.Delivered++
+	return "SUCCESS"
+}
+
+// receivedMessagesSet returns the dedup set backing the given topic.
+func receivedMessagesSet(topic string) sets.String {
+	switch topic {
+	case pubsubA:
+		return receivedMessagesA
+	case pubsubB:
+		return receivedMessagesB
+	case pubsubC:
+		return receivedMessagesC
+	default:
+		return nil
+	}
+}
+
+// matchTopic returns the known topic constant that urlPath is routed for, or "" if none match.
+func matchTopic(urlPath string) string {
+	switch {
+	case strings.HasSuffix(urlPath, pubsubA):
+		return pubsubA
+	case strings.HasSuffix(urlPath, pubsubB):
+		return pubsubB
+	case strings.HasSuffix(urlPath, pubsubC):
+		return pubsubC
+	default:
+		return ""
+	}
+}
+
+// deliveryKey identifies a message delivery for deliveryAttempts, scoped by
+// topic so that id-less messages (e.g. plain JSON envelopes with no "id"
+// field) on different topics don't share one global attempt counter.
+func deliveryKey(topic, id string) string {
+	return topic + "|" + id
+}
+
+// shouldRetryBeforeSuccess reports whether the delivery for message id on
+// topic should be retried, per the threshold configured via
+// /tests/set-fail-after. It counts attempts as they're seen, so the caller
+// gets RETRY for the first N deliveries of a given (topic, id) and SUCCESS
+// after that.
+func shouldRetryBeforeSuccess(topic, id string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	count, ok := failAfterCount[topic]
+	if !ok || count <= 0 {
+		return false
+	}
+	key := deliveryKey(topic, id)
+	if deliveryAttempts[key] < count {
+		deliveryAttempts[key]++
+		return true
+	}
+	return false
+}
+
+// this handles messages published to the dead-letter topic "pubsub-dlq-topic"
+func deadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("deadLetterHandler is called %s\n", r.URL)
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(appResponse{Message: err.Error(), Status: "DROP"})
+		return
+	}
+
+	_, ce, err := extractMessage(r, body)
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(appResponse{Message: err.Error(), Status: "DROP"})
+		return
+	}
+
+	redeliveryCount, _ := strconv.Atoi(r.Header.Get(redeliveryCountHeader))
+
+	lock.Lock()
+	defer lock.Unlock()
+	receivedDeadLetters[ce.ID] = deadLetterRecord{
+		OriginalTopic:   ce.Topic,
+		ID:              ce.ID,
+		RedeliveryCount: redeliveryCount,
+		Status:          "DEAD_LETTERED",
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(appResponse{
+		Message: "consumed",
+		Status:  "SUCCESS",
+	})
+}
+
 // this handles messages published to "pubsub-a-topic"
 func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("aHandler is called %s\n", r.URL)
@@ -140,7 +611,7 @@ func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg, err := extractMessage(body)
+	msg, ce, err := extractMessage(r, body)
 	if err != nil {
 		// Return success with DROP status to drop message
 		w.WriteHeader(http.StatusOK)
@@ -151,13 +622,26 @@ func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if matched := matchTopic(r.URL.String()); matched != "" && shouldRetryBeforeSuccess(matched, ce.ID) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(appResponse{
+			Message: "retry later",
+			Status:  "RETRY",
+		})
+		return
+	}
+
 	lock.Lock()
 	defer lock.Unlock()
+	var topic string
 	if strings.HasSuffix(r.URL.String(), pubsubA) && !receivedMessagesA.Has(msg) {
+		topic = pubsubA
 		receivedMessagesA.Insert(msg)
 	} else if strings.HasSuffix(r.URL.String(), pubsubB) && !receivedMessagesB.Has(msg) {
+		topic = pubsubB
 		receivedMessagesB.Insert(msg)
 	} else if strings.HasSuffix(r.URL.String(), pubsubC) && !receivedMessagesC.Has(msg) {
+		topic = pubsubC
 		receivedMessagesC.Insert(msg)
 	} else {
 		// This case is triggered when there is multiple redelivery of same message or a message
@@ -174,6 +658,24 @@ func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Legacy plain-JSON publishers don't set an id, so fall back to the
+	// message content (already confirmed unique above) to avoid every
+	// id-less message on a topic colliding on the same "" key.
+	ceKey := ce.ID
+	if ceKey == "" {
+		ceKey = msg
+	}
+	if _, ok := receivedCloudEvents[topic]; !ok {
+		receivedCloudEvents[topic] = map[string]cloudEvent{}
+	}
+	receivedCloudEvents[topic][ceKey] = ce
+
+	broker.publish(topic, streamEvent{
+		ID:         ce.ID,
+		Msg:        msg,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+
 	w.WriteHeader(http.StatusOK)
 	if respondWithEmptyJSON {
 		w.Write([]byte("{}"))
@@ -185,22 +687,97 @@ func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func extractMessage(body []byte) (string, error) {
+// extractMessage parses the request body/headers into a CloudEvents 1.0
+// envelope, handling both the structured mode (Content-Type:
+// application/cloudevents+json, the whole envelope is the JSON body) and the
+// binary mode (the event attributes travel as ce-* headers and the body is
+// the raw data). Requests that carry neither are decoded via the Codec
+// registered for their Content-Type (JSON, protobuf or msgpack), so the data
+// payload doesn't have to be JSON. It returns the decoded message data as a
+// string, plus the parsed envelope.
+func extractMessage(r *http.Request, body []byte) (string, cloudEvent, error) {
 	log.Printf("extractMessage() called")
-
 	log.Printf("body=%s", string(body))
 
-	m := make(map[string]interface{})
-	err := json.Unmarshal(body, &m)
-	if err != nil {
-		log.Printf("Could not unmarshal, %s", err.Error())
-		return "", err
+	var ce cloudEvent
+	switch {
+	case isStructuredCloudEvent(r):
+		if err := json.Unmarshal(body, &ce); err != nil {
+			log.Printf("Could not unmarshal cloudevent, %s", err.Error())
+			return "", cloudEvent{}, err
+		}
+	case isBinaryCloudEvent(r):
+		ce = cloudEvent{
+			ID:              r.Header.Get("ce-id"),
+			Source:          r.Header.Get("ce-source"),
+			Type:            r.Header.Get("ce-type"),
+			SpecVersion:     r.Header.Get("ce-specversion"),
+			DataContentType: r.Header.Get("ce-datacontenttype"),
+			Subject:         r.Header.Get("ce-subject"),
+			Time:            r.Header.Get("ce-time"),
+			Data:            string(body),
+			TraceParent:     r.Header.Get("ce-traceparent"),
+			TraceState:      r.Header.Get("ce-tracestate"),
+		}
+	default:
+		// not a CloudEvent: dispatch on Content-Type (or the forced /tests/set-codec
+		// override) to decode the payload, JSON, protobuf or msgpack alike.
+		contentType := baseContentType(r.Header.Get("Content-Type"))
+		id, payload, err := resolveCodec(contentType).Decode(contentType, body)
+		if err != nil {
+			log.Printf("Could not decode message, %s", err.Error())
+			return "", cloudEvent{}, err
+		}
+		ce = cloudEvent{ID: id, Data: string(payload)}
+	}
+
+	if ce.DataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(ce.DataBase64)
+		if err != nil {
+			log.Printf("Could not base64-decode data_base64, %s", err.Error())
+			return "", cloudEvent{}, err
+		}
+		ce.Data = string(decoded)
+		ce.DataBase64 = ""
+	}
+
+	if isStructuredCloudEvent(r) || isBinaryCloudEvent(r) {
+		if err := validateCloudEvent(ce); err != nil {
+			return "", cloudEvent{}, err
+		}
+	}
+
+	msg, ok := ce.Data.(string)
+	if !ok {
+		err := errors.New("data is not a string")
+		log.Printf(err.Error())
+		return "", cloudEvent{}, err
 	}
 
-	msg := m["data"].(string)
 	log.Printf("output='%s'\n", msg)
 
-	return msg, nil
+	return msg, ce, nil
+}
+
+// isStructuredCloudEvent reports whether the request carries a CloudEvents
+// 1.0 envelope as the whole JSON body (structured content mode).
+func isStructuredCloudEvent(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Content-Type"), contentTypeCloudEvent)
+}
+
+// isBinaryCloudEvent reports whether the request carries a CloudEvents 1.0
+// envelope as ce-* headers plus a raw data body (binary content mode).
+func isBinaryCloudEvent(r *http.Request) bool {
+	return r.Header.Get("ce-id") != "" || r.Header.Get("ce-specversion") != ""
+}
+
+// validateCloudEvent checks that the required CloudEvents 1.0 attributes
+// are present.
+func validateCloudEvent(ce cloudEvent) error {
+	if ce.SpecVersion == "" || ce.Type == "" || ce.Source == "" || ce.ID == "" {
+		return errors.New("cloudevent is missing one of the required attributes: specversion, type, source, id")
+	}
+	return nil
 }
 
 // the test calls this to get the messages received
@@ -219,6 +796,161 @@ func getReceivedMessages(w http.ResponseWriter, _ *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// the test calls this to get the full CloudEvents envelopes received, keyed by topic.
+func getReceivedCloudEvents(w http.ResponseWriter, _ *http.Request) {
+	log.Println("Enter getReceivedCloudEvents")
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	response := map[string][]cloudEvent{}
+	for topic, byID := range receivedCloudEvents {
+		for _, ce := range byID {
+			response[topic] = append(response[topic], ce)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+const streamPingInterval = 30 * time.Second
+
+// streamHandler upgrades to a Server-Sent Events stream and emits one event
+// per message accepted by subscribeHandler, so e2e tests can observe
+// delivery ordering and latency without polling /tests/get.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Enter streamHandler")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	id, ch := broker.subscribe()
+	defer broker.unsubscribe(id)
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case te, ok := <-ch:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(te.event)
+			if err != nil {
+				log.Printf("could not marshal stream event, %s", err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", te.topic, payload)
+			flusher.Flush()
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// force a codec regardless of Content-Type, via JSON body {"codec":"protobuf"}.
+// An empty codec name reverts to Content-Type-based selection.
+func setCodec(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var body struct {
+		Codec string `json:"codec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Codec != "" {
+		if _, ok := codecs[body.Codec]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	log.Printf("set codec to %q", body.Codec)
+	forcedCodec = body.Codec
+	w.WriteHeader(http.StatusOK)
+}
+
+// set the entryId substring that bulk entries must match for the respond-with-error/retry
+// toggles to apply to them, via JSON body {"pattern":"..."}
+func setBulkFailurePattern(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var body struct {
+		Pattern string `json:"pattern"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	log.Printf("set bulk failure pattern to %q", body.Pattern)
+	bulkFailurePattern = body.Pattern
+	w.WriteHeader(http.StatusOK)
+}
+
+// the test calls this to get counts of delivered/retried/dropped/duplicated bulk entries
+func getBulkStats(w http.ResponseWriter, _ *http.Request) {
+	log.Println("Enter getBulkStats")
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bulkStats)
+}
+
+// set the number of times delivery of each message id on a topic should be
+// retried before succeeding, via JSON body {"topic":"pubsub-a-topic","count":3}
+func setFailAfter(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var body struct {
+		Topic string `json:"topic"`
+		Count int    `json:"count"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	log.Printf("set fail-after for topic %s to %d", body.Topic, body.Count)
+	failAfterCount[body.Topic] = body.Count
+	w.WriteHeader(http.StatusOK)
+}
+
+// the test calls this to get the redelivery counts and disposition of messages routed to the dead-letter topic
+func getDeadLetters(w http.ResponseWriter, _ *http.Request) {
+	log.Println("Enter getDeadLetters")
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(receivedDeadLetters)
+}
+
 // set to respond with error on receiving messages from pubsub
 func setRespondWithError(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -261,6 +993,13 @@ func initializeSets() {
 	receivedMessagesA = sets.NewString()
 	receivedMessagesB = sets.NewString()
 	receivedMessagesC = sets.NewString()
+	receivedCloudEvents = map[string]map[string]cloudEvent{}
+	bulkStats = bulkStatsResponse{}
+	if failAfterCount == nil {
+		failAfterCount = map[string]int{}
+	}
+	deliveryAttempts = map[string]int{}
+	receivedDeadLetters = map[string]deadLetterRecord{}
 }
 
 // appRouter initializes restful api router
@@ -271,16 +1010,28 @@ func appRouter() *mux.Router {
 	router.HandleFunc("/", indexHandler).Methods("GET")
 
 	router.HandleFunc("/tests/get", getReceivedMessages).Methods("POST")
+	router.HandleFunc("/tests/get-cloudevents", getReceivedCloudEvents).Methods("POST")
 	router.HandleFunc("/tests/set-respond-error", setRespondWithError).Methods("POST")
 	router.HandleFunc("/tests/set-respond-retry", setRespondWithRetry).Methods("POST")
 	router.HandleFunc("/tests/set-respond-empty-json", setRespondEmptyJSON).Methods("POST")
+	router.HandleFunc("/tests/set-bulk-failure-pattern", setBulkFailurePattern).Methods("POST")
+	router.HandleFunc("/tests/get-bulk-stats", getBulkStats).Methods("POST")
+	router.HandleFunc("/tests/set-fail-after", setFailAfter).Methods("POST")
+	router.HandleFunc("/tests/get-deadletters", getDeadLetters).Methods("POST")
+	router.HandleFunc("/tests/stream", streamHandler).Methods("GET")
+	router.HandleFunc("/tests/set-codec", setCodec).Methods("POST")
 	router.HandleFunc("/tests/initialize", initializeHandler).Methods("POST")
 
 	router.HandleFunc("/dapr/subscribe", configureSubscribeHandler).Methods("GET")
+	router.HandleFunc("/dapr/subscribe-bulk", configureBulkSubscribeHandler).Methods("GET")
 
 	router.HandleFunc("/"+pubsubA, subscribeHandler).Methods("POST")
 	router.HandleFunc("/"+pubsubB, subscribeHandler).Methods("POST")
 	router.HandleFunc("/"+pubsubC, subscribeHandler).Methods("POST")
+	router.HandleFunc("/"+pubsubDLQ, deadLetterHandler).Methods("POST")
+	router.HandleFunc("/"+pubsubA+"-bulk", bulkSubscribeHandler).Methods("POST")
+	router.HandleFunc("/"+pubsubB+"-bulk", bulkSubscribeHandler).Methods("POST")
+	router.HandleFunc("/"+pubsubC+"-bulk", bulkSubscribeHandler).Methods("POST")
 	router.Use(mux.CORSMethodMiddleware(router))
 
 	return router
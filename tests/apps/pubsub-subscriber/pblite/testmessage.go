@@ -0,0 +1,119 @@
+// ------------------------------------------------------------
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+// ------------------------------------------------------------
+
+// Package pblite is a minimal, hand-written protobuf wire-format codec for
+// the pub/sub test app's TestMessage (id/payload) payload. It is NOT
+// generated by protoc-gen-go and does not implement proto.Message — don't
+// mistake it for the real bindings of ../pblite/testmessage.proto. If actual
+// generated Go bindings are added for that .proto, update protobufCodec in
+// app.go to use them instead of this package.
+package pblite
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// TestMessage is the protobuf payload envelope used by the pub/sub test app
+// when Content-Type is application/x-protobuf (or the CloudEvents structured
+// application/cloudevents+protobuf variant).
+type TestMessage struct {
+	Id      string
+	Payload []byte
+}
+
+// Marshal encodes m using the standard protobuf wire format.
+func (m *TestMessage) Marshal() ([]byte, error) {
+	buf := make([]byte, 0, len(m.Id)+len(m.Payload)+16)
+	buf = appendTag(buf, 1, 2)
+	buf = appendVarint(buf, uint64(len(m.Id)))
+	buf = append(buf, m.Id...)
+	buf = appendTag(buf, 2, 2)
+	buf = appendVarint(buf, uint64(len(m.Payload)))
+	buf = append(buf, m.Payload...)
+	return buf, nil
+}
+
+// Unmarshal decodes a TestMessage from its protobuf wire format. Fields
+// other than id/payload, and varint, 64-bit and 32-bit fields, are skipped
+// rather than rejected: forward/backward compatibility is the entire point
+// of the protobuf wire format, so an unknown field must not fail the whole
+// message. Group wire types (3, 4) and invalid wire types return an error.
+func Unmarshal(data []byte) (*TestMessage, error) {
+	m := &TestMessage{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("pblite: invalid field tag")
+		}
+		data = data[n:]
+
+		field := tag >> 3
+		wireType := tag & 0x7
+
+		value, rest, err := consumeField(wireType, data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		if wireType != 2 {
+			continue
+		}
+		switch field {
+		case 1:
+			m.Id = string(value)
+		case 2:
+			m.Payload = append([]byte{}, value...)
+		}
+	}
+	return m, nil
+}
+
+// consumeField reads one field's value off data per its wire type and
+// returns the raw bytes (only meaningful for wireType 2) plus the remainder
+// of data.
+func consumeField(wireType uint64, data []byte) ([]byte, []byte, error) {
+	switch wireType {
+	case 0: // varint
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, errors.New("pblite: invalid varint field")
+		}
+		return nil, data[n:], nil
+	case 1: // 64-bit
+		if len(data) < 8 {
+			return nil, nil, errors.New("pblite: truncated 64-bit field")
+		}
+		return nil, data[8:], nil
+	case 2: // length-delimited
+		length, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, errors.New("pblite: invalid field length")
+		}
+		data = data[n:]
+		if uint64(len(data)) < length {
+			return nil, nil, errors.New("pblite: truncated field")
+		}
+		return data[:length], data[length:], nil
+	case 5: // 32-bit
+		if len(data) < 4 {
+			return nil, nil, errors.New("pblite: truncated 32-bit field")
+		}
+		return nil, data[4:], nil
+	default:
+		return nil, nil, errors.New("pblite: unsupported wire type")
+	}
+}
+
+func appendTag(buf []byte, field, wireType int) []byte {
+	return appendVarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}